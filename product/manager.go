@@ -16,15 +16,13 @@ package product
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/apigee/apigee-remote-service-golib/auth"
@@ -49,69 +47,185 @@ Usage:
 type Manager interface {
 	Products() ProductsMap
 	Resolve(ac *auth.Context, api, path string) []*APIProduct
+	ResolveContext(ctx context.Context, ac *auth.Context, api, path string) []*APIProduct
+	Use(mw ...ResolveMiddleware)
 	Close()
 }
 
+// ResolveFunc resolves the valid products for a request. It is both the
+// terminal step of a manager's resolve chain and the signature every
+// ResolveMiddleware wraps.
+type ResolveFunc func(ctx context.Context, ac *auth.Context, api, path string) ([]*APIProduct, []string)
+
+// ResolveMiddleware wraps a ResolveFunc to add cross-cutting behavior around
+// product resolution - e.g. deadlines, audit logging of which product won
+// and why, A/B overrides that force-select a product by header, scope
+// relaxation for break-glass callers, or latency histograms. Middleware may
+// append its own reasons to the failHints it receives from next.
+type ResolveMiddleware func(next ResolveFunc) ResolveFunc
+
+// TenantKey identifies a single org/env pair served by a multi-tenant manager.
+type TenantKey string
+
+// tenantKey builds the canonical key for an org/env pair.
+func tenantKey(org, env string) TenantKey {
+	return TenantKey(org + "/" + env)
+}
+
+// Tenant describes one org/env's Apigee connection. A manager may serve
+// many of these concurrently out of a single process. Source, when set,
+// takes precedence over BaseURL/Key/Secret; otherwise an HTTPSource built
+// from those fields is used.
+type Tenant struct {
+	Org     string
+	Env     string
+	BaseURL *url.URL
+	Key     string
+	Secret  string
+	Source  Source
+}
+
+// TenantSelector picks which tenant's products should be used to resolve an
+// auth.Context. The default selector uses ac.Tenant.
+type TenantSelector func(ac *auth.Context) TenantKey
+
+func defaultTenantSelector(ac *auth.Context) TenantKey {
+	return TenantKey(ac.Tenant)
+}
+
 func createManager(options Options) *manager {
-	return &manager{
-		baseURL:          options.BaseURL,
-		closedChan:       make(chan bool),
-		returnChan:       make(chan map[string]*APIProduct),
-		closed:           util.NewAtomicBool(false),
-		refreshRate:      options.RefreshRate,
-		client:           options.Client,
-		key:              options.Key,
-		secret:           options.Secret,
-		prometheusLabels: prometheus.Labels{"org": options.Org, "env": options.Env},
+	tenants := options.Tenants
+	if len(tenants) == 0 {
+		// legacy single-tenant configuration
+		tenants = []Tenant{{
+			Org:     options.Org,
+			Env:     options.Env,
+			BaseURL: options.BaseURL,
+			Key:     options.Key,
+			Secret:  options.Secret,
+			Source:  options.Source,
+		}}
+	}
+
+	selector := options.TenantSelector
+	if selector == nil {
+		selector = defaultTenantSelector
+	}
+
+	m := &manager{
+		closedChan:      make(chan bool),
+		returnChan:      make(chan map[string]*APIProduct),
+		closed:          util.NewAtomicBool(false),
+		refreshRate:     options.RefreshRate,
+		client:          options.Client,
+		tenants:         make(map[TenantKey]*tenantState, len(tenants)),
+		tenantSelector:  selector,
+		useRegexResolve: options.UseRegexPathMatching,
+	}
+	for _, t := range tenants {
+		key := tenantKey(t.Org, t.Env)
+		source := t.Source
+		if source == nil {
+			source = &HTTPSource{Client: options.Client, BaseURL: t.BaseURL, Key: t.Key, Secret: t.Secret}
+		}
+		m.tenants[key] = &tenantState{
+			tenant:           t,
+			source:           source,
+			prometheusLabels: prometheus.Labels{"org": t.Org, "env": t.Env, "tenant": string(key)},
+		}
+		if m.defaultTenant == "" {
+			m.defaultTenant = key
+		}
 	}
+	return m
+}
+
+// tenantState holds the per-tenant polling and product state.
+type tenantState struct {
+	tenant           Tenant
+	source           Source
+	productsMux      productsMux
+	cancelPolling    context.CancelFunc
+	prometheusLabels prometheus.Labels
 }
 
 type manager struct {
-	baseURL          *url.URL
 	closed           *util.AtomicBool
 	closedChan       chan bool
 	returnChan       chan map[string]*APIProduct
 	refreshRate      time.Duration
 	refreshTimerChan <-chan time.Time
 	client           *http.Client
-	key              string
-	secret           string
-	productsMux      productsMux
-	cancelPolling    context.CancelFunc
-	prometheusLabels prometheus.Labels
+	tenants          map[TenantKey]*tenantState
+	defaultTenant    TenantKey
+	tenantSelector   TenantSelector
+	useRegexResolve  bool // if true, resolve via the legacy per-product regex scan instead of the pathIndex
+	middlewareMu     sync.RWMutex
+	middleware       []ResolveMiddleware
+}
+
+// Use registers mw, in order, around the manager's resolve chain. Middleware
+// registered first runs outermost; the chain always terminates in the
+// manager's own resolveBase. Use may be called concurrently with Resolve/
+// ResolveContext, e.g. from a background goroutine that installs middleware
+// after start().
+func (p *manager) Use(mw ...ResolveMiddleware) {
+	p.middlewareMu.Lock()
+	defer p.middlewareMu.Unlock()
+	p.middleware = append(p.middleware, mw...)
 }
 
 func (p *manager) start() {
 	log.Infof("starting product manager")
-	p.productsMux = productsMux{
-		setChan:   make(chan ProductsMap),
-		getChan:   make(chan ProductsMap),
-		closeChan: make(chan struct{}),
-		closed:    util.NewAtomicBool(false),
-	}
-	go p.productsMux.mux()
-
-	poller := util.Looper{
-		Backoff: util.NewExponentialBackoff(200*time.Millisecond, p.refreshRate, 2, true),
-	}
-	apiURL := *p.baseURL
-	apiURL.Path = path.Join(apiURL.Path, productsURL)
-	ctx, cancel := context.WithCancel(context.Background())
-	p.cancelPolling = cancel
-	poller.Start(ctx, p.pollingClosure(apiURL), p.refreshRate, func(err error) error {
-		log.Errorf("Error retrieving products: %v", err)
-		return nil
-	})
+
+	for key, ts := range p.tenants {
+		ts := ts
+		ts.productsMux = productsMux{
+			setChan:   make(chan productsSnapshot),
+			getChan:   make(chan productsSnapshot),
+			closeChan: make(chan struct{}),
+			closed:    util.NewAtomicBool(false),
+		}
+		go ts.productsMux.mux()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ts.cancelPolling = cancel
+
+		poller := util.Looper{
+			Backoff: util.NewExponentialBackoff(200*time.Millisecond, p.refreshRate, 2, true),
+		}
+
+		if watchable, ok := ts.source.(WatchableSource); ok {
+			poller.Start(ctx, p.watchClosure(ts, watchable), p.refreshRate, func(err error) error {
+				log.Errorf("Error watching products for tenant %s: %v", key, err)
+				return nil
+			})
+			continue
+		}
+
+		poller.Start(ctx, p.pollingClosure(ts), p.refreshRate, func(err error) error {
+			log.Errorf("Error retrieving products for tenant %s: %v", key, err)
+			return nil
+		})
+	}
 
 	log.Infof("started product manager")
 }
 
-// Products atomically gets a mapping of name => APIProduct.
+// Products atomically gets a mapping of name => APIProduct for the default tenant.
 func (p *manager) Products() ProductsMap {
 	if p.closed.IsTrue() {
 		return nil
 	}
-	return p.productsMux.Get()
+	return p.productsFor(p.defaultTenant)
+}
+
+func (p *manager) productsFor(key TenantKey) ProductsMap {
+	ts, ok := p.tenants[key]
+	if !ok {
+		return nil
+	}
+	return ts.productsMux.Get().products
 }
 
 // Close shuts down the manager.
@@ -120,60 +234,108 @@ func (p *manager) Close() {
 		return
 	}
 	log.Infof("closing product manager")
-	p.cancelPolling()
-	p.productsMux.Close()
+	for _, ts := range p.tenants {
+		ts.cancelPolling()
+		ts.productsMux.Close()
+	}
 	log.Infof("closed product manager")
 }
 
-func (p *manager) pollingClosure(apiURL url.URL) func(ctx context.Context) error {
+func (p *manager) pollingClosure(ts *tenantState) func(ctx context.Context) error {
 	return func(ctx context.Context) error {
-
-		req, err := http.NewRequest(http.MethodGet, apiURL.String(), nil)
+		res, err := ts.source.Fetch(ctx)
+		if err == ErrNotModified {
+			log.Debugf("products not modified since last poll, keeping cached set")
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		req = req.WithContext(ctx) // make cancelable from poller
-
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Accept", "application/json")
-		req.SetBasicAuth(p.key, p.secret)
-
-		log.Debugf("retrieving products from: %s", apiURL.String())
+		p.applyResponse(ctx, ts, res)
+		return nil
+	}
+}
 
-		resp, err := p.client.Do(req)
-		if err != nil {
-			return err
+// watchClosure seeds ts with an initial snapshot via a one-time Fetch (so
+// Products()/Resolve() don't block forever waiting on a push that may not
+// come for a while, e.g. a FileSource whose file never changes again), then
+// subscribes to watchable.Watch and applies every update it sends until the
+// channel closes. It is driven by the same util.Looper/backoff as polling,
+// so a transient failure to establish the watch (or the watch ending) is
+// retried rather than permanently stranding the tenant with no products.
+// A source that can't answer a one-off Fetch at all (ErrFetchUnsupported,
+// e.g. GRPCStreamSource) simply skips seeding and waits on Watch's first
+// update instead, rather than being treated as a seeding failure.
+func (p *manager) watchClosure(ts *tenantState, watchable WatchableSource) func(ctx context.Context) error {
+	seeded := false
+	return func(ctx context.Context) error {
+		if !seeded {
+			res, err := ts.source.Fetch(ctx)
+			switch {
+			case err == ErrNotModified, err == ErrFetchUnsupported:
+			case err != nil:
+				return fmt.Errorf("seeding initial products: %v", err)
+			default:
+				p.applyResponse(ctx, ts, res)
+			}
+			seeded = true
 		}
-		defer resp.Body.Close()
 
-		body, err := ioutil.ReadAll(resp.Body)
+		updates, err := watchable.Watch(ctx)
 		if err != nil {
-			log.Errorf("Unable to read server response: %v", err)
 			return err
 		}
-
-		if resp.StatusCode != 200 {
-			err := fmt.Errorf("products request failed (%d): %s", resp.StatusCode, string(body))
-			log.Errorf(err.Error())
-			return err
+		for res := range updates {
+			p.applyResponse(ctx, ts, res)
 		}
-
-		var res APIResponse
-		err = json.Unmarshal(body, &res)
-		if err != nil {
-			log.Errorf("unable to unmarshal JSON response '%s': %v", string(body), err)
-			return err
+		if ctx.Err() != nil {
+			return nil
 		}
+		return fmt.Errorf("products watch ended unexpectedly")
+	}
+}
 
-		pm := p.getProductsMap(ctx, res)
-		p.productsMux.Set(pm)
+// applyResponse folds a freshly fetched or pushed APIResponse into ts,
+// whether it came from a polling Source.Fetch or a WatchableSource update.
+func (p *manager) applyResponse(ctx context.Context, ts *tenantState, res APIResponse) {
+	var pm ProductsMap
+	// res.IsDelta is the server's own envelope discriminator; a delta
+	// response with nothing changed can legitimately have an empty Deleted,
+	// Changed and even Cursor, so inferring "is this a delta" from those
+	// being non-empty would wipe the cached ProductsMap on such a response.
+	if res.IsDelta {
+		pm = p.applyDelta(ctx, ts.productsMux.Get().products, res)
+	} else {
+		pm = p.getProductsMap(ctx, res)
+	}
 
-		prometheusProductsRecords.With(p.prometheusLabels).Set(float64(len(pm)))
+	s := productsSnapshot{products: pm}
+	if !p.useRegexResolve {
+		s.index = buildPathIndex(pm)
+	}
+	ts.productsMux.Set(s)
 
-		log.Debugf("retrieved %d products, kept %d", len(res.APIProducts), len(pm))
+	prometheusProductsRecords.With(ts.prometheusLabels).Set(float64(len(pm)))
 
-		return nil
+	log.Debugf("retrieved %d products (%d changed, %d deleted), kept %d",
+		len(res.APIProducts), len(res.Changed), len(res.Deleted), len(pm))
+}
+
+// applyDelta merges a server-side "delta since cursor" response into the
+// current ProductsMap instead of replacing it wholesale. This avoids
+// reparsing and recompiling resource matchers for unchanged products.
+func (p *manager) applyDelta(ctx context.Context, current ProductsMap, res APIResponse) ProductsMap {
+	pm := make(ProductsMap, len(current))
+	for name, apiProduct := range current {
+		pm[name] = apiProduct
+	}
+	for _, name := range res.Deleted {
+		delete(pm, name)
 	}
+	for name, apiProduct := range p.getProductsMap(ctx, APIResponse{APIProducts: res.Changed}) {
+		pm[name] = apiProduct
+	}
+	return pm
 }
 
 func (p *manager) getProductsMap(ctx context.Context, res APIResponse) ProductsMap {
@@ -219,7 +381,12 @@ func (p *manager) getProductsMap(ctx context.Context, res APIResponse) ProductsM
 					product.QuotaTimeUnit = ""
 				}
 
-				p.resolveResourceMatchers(&product)
+				// Only the legacy regex resolve path needs resourceRegexps;
+				// building them is wasted work on every refresh tick when
+				// the pathIndex is doing the matching instead.
+				if p.useRegexResolve {
+					p.resolveResourceMatchers(&product)
+				}
 
 				pm[product.Name] = &product
 				break
@@ -241,9 +408,30 @@ func (p *manager) resolveResourceMatchers(product *APIProduct) {
 	}
 }
 
-// Resolve determines the valid products for a given API.
+// Resolve determines the valid products for a given API. It is equivalent
+// to ResolveContext(context.Background(), ac, api, path).
 func (p *manager) Resolve(ac *auth.Context, api, path string) []*APIProduct {
-	validProducts, failHints := resolve(ac, p.Products(), api, path)
+	return p.ResolveContext(context.Background(), ac, api, path)
+}
+
+// ResolveContext runs ac/api/path through the manager's middleware chain
+// (registered via Use), which terminates in resolveBase. The tenant whose
+// products are searched is chosen by the manager's TenantSelector. When it
+// returns the zero value, the only tenant is used if exactly one is
+// registered; with more than one, no products are resolved.
+func (p *manager) ResolveContext(ctx context.Context, ac *auth.Context, api, path string) []*APIProduct {
+	p.middlewareMu.RLock()
+	middleware := make([]ResolveMiddleware, len(p.middleware))
+	copy(middleware, p.middleware)
+	p.middlewareMu.RUnlock()
+
+	chain := ResolveFunc(p.resolveBase)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		chain = middleware[i](chain)
+	}
+
+	validProducts, failHints := chain(ctx, ac, api, path)
+
 	var selected []string
 	for _, p := range validProducts {
 		selected = append(selected, p.Name)
@@ -255,6 +443,36 @@ Eliminated: %v`, api, path, ac.Scopes, selected, failHints)
 	return validProducts
 }
 
+// resolveBase is the default, terminal ResolveFunc: it looks up ac's tenant
+// and resolves against that tenant's current ProductsMap, via the pathIndex
+// unless useRegexResolve is set.
+func (p *manager) resolveBase(ctx context.Context, ac *auth.Context, api, path string) ([]*APIProduct, []string) {
+	key := p.tenantSelector(ac)
+	if key == "" {
+		// Only a single-tenant manager can safely treat "no tenant selected"
+		// as "use the one tenant there is". With more than one tenant
+		// registered, guessing would silently resolve the request against
+		// whichever tenant happened to be first; fail closed instead.
+		if len(p.tenants) != 1 {
+			return nil, []string{"no tenant could be determined for this request"}
+		}
+		key = p.defaultTenant
+	}
+	ts, ok := p.tenants[key]
+	if !ok {
+		return nil, nil
+	}
+	s, err := ts.productsMux.GetContext(ctx)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("resolve canceled: %v", err)}
+	}
+
+	if !p.useRegexResolve && s.index != nil {
+		return resolveViaIndex(ac, s.products, s.index, api, path)
+	}
+	return resolve(ac, s.products, api, path)
+}
+
 func resolve(ac *auth.Context, pMap map[string]*APIProduct, api, path string) (
 	result []*APIProduct, failHints []string) {
 
@@ -282,6 +500,52 @@ func resolve(ac *auth.Context, pMap map[string]*APIProduct, api, path string) (
 	return result, failHints
 }
 
+// resolveViaIndex is the pathIndex-backed equivalent of resolve: it walks
+// idx for path once instead of scanning every candidate product's
+// resourceRegexps and isValidTarget linearly, but otherwise preserves
+// resolve's semantics exactly - same ac.APIProducts iteration order (so
+// callers that treat the first result as the winner see the same product),
+// and the same distinct "doesn't match path" vs "doesn't match target"
+// failHints. The one exception is a resource that pathIndex.insert refuses
+// to index (a "**" glued to a literal segment, e.g. "/a/b**"): it matches
+// no path here, although resolve's regex would match it.
+func resolveViaIndex(ac *auth.Context, pMap ProductsMap, idx *pathIndex, api, path string) (
+	result []*APIProduct, failHints []string) {
+
+	matchedAnyTarget := map[string]bool{}
+	matchedTarget := map[string]bool{}
+	for _, entry := range idx.match(path) {
+		matchedAnyTarget[entry.product] = true
+		if entry.api == api {
+			matchedTarget[entry.product] = true
+		}
+	}
+
+	for _, name := range ac.APIProducts {
+		apiProduct, ok := pMap[name]
+		if !ok {
+			failHints = append(failHints, fmt.Sprintf("%s doesn't exist", name))
+			continue
+		}
+		// if APIKey, scopes don't matter
+		if ac.APIKey == "" && !apiProduct.isValidScopes(ac.Scopes) {
+			failHints = append(failHints, fmt.Sprintf("%s doesn't match scopes: %s", name, ac.Scopes))
+			continue
+		}
+		if !matchedAnyTarget[name] {
+			failHints = append(failHints, fmt.Sprintf("%s doesn't match path: %s", name, path))
+			continue
+		}
+		if !matchedTarget[name] {
+			failHints = append(failHints, fmt.Sprintf("%s doesn't match target: %s", name, api))
+			continue
+		}
+		result = append(result, apiProduct)
+	}
+
+	return result, failHints
+}
+
 // true if valid target for API Product
 func (p *APIProduct) isValidTarget(api string) bool {
 	for _, target := range p.Targets {
@@ -371,18 +635,41 @@ func makeResourceRegex(resource string) (*regexp.Regexp, error) {
 // ProductsMap is a map of API Product name to API Product
 type ProductsMap map[string]*APIProduct
 
+// productsSnapshot bundles a tenant's current ProductsMap with the
+// pathIndex built from it, so a single productsMux.Set publishes both
+// atomically - a reader's Get can never observe a new ProductsMap paired
+// with a stale (or missing) pathIndex, or vice versa.
+type productsSnapshot struct {
+	products ProductsMap
+	index    *pathIndex
+}
+
 type productsMux struct {
-	setChan   chan ProductsMap
-	getChan   chan ProductsMap
+	setChan   chan productsSnapshot
+	getChan   chan productsSnapshot
 	closeChan chan struct{}
 	closed    *util.AtomicBool
 }
 
-func (h productsMux) Get() ProductsMap {
-	return <-h.getChan
+// Get blocks until a snapshot is available. Callers with a caller-scoped
+// deadline or cancellation to honor should use GetContext instead.
+func (h productsMux) Get() productsSnapshot {
+	s, _ := h.GetContext(context.Background())
+	return s
+}
+
+// GetContext is Get, but returns early with ctx.Err() if ctx is done before
+// a snapshot becomes available.
+func (h productsMux) GetContext(ctx context.Context) (productsSnapshot, error) {
+	select {
+	case s := <-h.getChan:
+		return s, nil
+	case <-ctx.Done():
+		return productsSnapshot{}, ctx.Err()
+	}
 }
 
-func (h productsMux) Set(s ProductsMap) {
+func (h productsMux) Set(s productsSnapshot) {
 	if h.closed.IsFalse() {
 		h.setChan <- s
 	}
@@ -395,21 +682,21 @@ func (h productsMux) Close() {
 }
 
 func (h productsMux) mux() {
-	var productsMap ProductsMap
+	var s productsSnapshot
 	for {
-		if productsMap == nil {
+		if s.products == nil {
 			select {
 			case <-h.closeChan:
 				close(h.setChan)
 				close(h.getChan)
 				return
-			case productsMap = <-h.setChan:
+			case s = <-h.setChan:
 				continue
 			}
 		}
 		select {
-		case productsMap = <-h.setChan:
-		case h.getChan <- productsMap:
+		case s = <-h.setChan:
+		case h.getChan <- s:
 		case <-h.closeChan:
 			close(h.setChan)
 			close(h.getChan)
@@ -423,5 +710,5 @@ var (
 		Subsystem: "products",
 		Name:      "cached",
 		Help:      "Number of products cached in memory",
-	}, []string{"org", "env"})
+	}, []string{"org", "env", "tenant"})
 )
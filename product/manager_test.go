@@ -0,0 +1,44 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package product
+
+import "testing"
+
+func TestTenantKey(t *testing.T) {
+	tests := []struct {
+		org, env string
+		want     TenantKey
+	}{
+		{"myorg", "test", "myorg/test"},
+		{"myorg", "prod", "myorg/prod"},
+		{"", "", "/"},
+	}
+	for _, tt := range tests {
+		if got := tenantKey(tt.org, tt.env); got != tt.want {
+			t.Errorf("tenantKey(%q, %q) = %q, want %q", tt.org, tt.env, got, tt.want)
+		}
+	}
+}
+
+// Multi-tenant resolve/fallback (tenantSelector, resolveBase), ETag/delta
+// merge handling (applyResponse, applyDelta), and the Source implementations
+// in source.go all need auth.Context, APIResponse, APIProduct, Options and
+// friends, none of which are defined anywhere in this checkout (there's no
+// go.mod here, and no auth/util/log sibling packages) - this directory is a
+// standalone snapshot of the product package. Fabricating those types here
+// to make the rest of this file compile would mean testing against an
+// invented schema that may not match the real one, which seems worse than
+// no test at all; tenantKey above is the one piece of this logic with no
+// such dependency.
@@ -0,0 +1,268 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package product
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/log"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+)
+
+// ErrNotModified is returned by a Source's Fetch when the underlying data
+// has not changed since the last successful fetch (e.g. an HTTP 304). The
+// manager treats it as "keep the cached ProductsMap" rather than an error.
+var ErrNotModified = errors.New("product: source not modified")
+
+// ErrFetchUnsupported is returned by a Source's Fetch when the source is
+// push-only (e.g. GRPCStreamSource) and has no way to answer a one-off poll.
+// The manager treats it as "nothing to seed with yet" rather than an error,
+// and relies on the source's first Watch update instead.
+var ErrFetchUnsupported = errors.New("product: source does not support Fetch; use Watch")
+
+// Source supplies API product data to a Manager. Fetch is called on every
+// poll tick; a Source that can instead push updates as they occur should
+// additionally implement WatchableSource.
+type Source interface {
+	Fetch(ctx context.Context) (APIResponse, error)
+}
+
+// WatchableSource is a Source that can push updates on its own schedule
+// instead of being polled. When a tenant's Source implements this, the
+// manager calls Fetch once to seed the tenant and then subscribes via Watch
+// rather than calling Fetch on a timer, subscribing again if the watch ends.
+type WatchableSource interface {
+	Source
+	Watch(ctx context.Context) (<-chan APIResponse, error)
+}
+
+// HTTPSource is the default Source: it polls the Apigee products REST API
+// with HTTP basic auth, and supports conditional GETs and server-side delta
+// responses via the ETag/Last-Modified/cursor fields it maintains itself.
+type HTTPSource struct {
+	Client  *http.Client
+	BaseURL *url.URL
+	Key     string
+	Secret  string
+
+	etag         string
+	lastModified string
+	cursor       string
+}
+
+// Fetch retrieves the current products snapshot, or ErrNotModified if
+// nothing has changed since the previous successful Fetch.
+func (s *HTTPSource) Fetch(ctx context.Context) (APIResponse, error) {
+	apiURL := *s.BaseURL
+	apiURL.Path = path.Join(apiURL.Path, productsURL)
+
+	req, err := http.NewRequest(http.MethodGet, apiURL.String(), nil)
+	if err != nil {
+		return APIResponse{}, err
+	}
+	req = req.WithContext(ctx) // make cancelable from poller
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(s.Key, s.Secret)
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if s.lastModified != "" {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+	if s.cursor != "" {
+		q := req.URL.Query()
+		q.Set("since", s.cursor)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	log.Debugf("retrieving products from: %s", apiURL.String())
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return APIResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return APIResponse{}, ErrNotModified
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return APIResponse{}, fmt.Errorf("unable to read server response: %v", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return APIResponse{}, fmt.Errorf("products request failed (%d): %s", resp.StatusCode, string(body))
+	}
+
+	var res APIResponse
+	if err := json.Unmarshal(body, &res); err != nil {
+		return APIResponse{}, fmt.Errorf("unable to unmarshal JSON response '%s': %v", string(body), err)
+	}
+
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+	if res.Cursor != "" {
+		s.cursor = res.Cursor
+	}
+
+	return res, nil
+}
+
+// FileSource loads an APIResponse from a JSON or YAML file on disk and,
+// via Watch, pushes a fresh read whenever the file changes. It exists for
+// air-gapped deployments and tests that run without a live control plane.
+type FileSource struct {
+	Path string
+}
+
+// Fetch reads and parses the file once.
+func (s *FileSource) Fetch(ctx context.Context) (APIResponse, error) {
+	return s.read()
+}
+
+func (s *FileSource) read() (APIResponse, error) {
+	body, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return APIResponse{}, err
+	}
+
+	var res APIResponse
+	switch strings.ToLower(filepath.Ext(s.Path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(body, &res)
+	default:
+		err = json.Unmarshal(body, &res)
+	}
+	if err != nil {
+		return APIResponse{}, fmt.Errorf("unable to parse products file %q: %v", s.Path, err)
+	}
+	return res, nil
+}
+
+// Watch re-reads Path whenever fsnotify reports it changed, pushing the
+// freshly parsed APIResponse. The returned channel is closed when ctx is
+// canceled or the watch can no longer continue.
+func (s *FileSource) Watch(ctx context.Context) (<-chan APIResponse, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(s.Path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	out := make(chan APIResponse)
+	go func() {
+		defer watcher.Close()
+		defer close(out)
+		target := filepath.Clean(s.Path)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != target || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				res, err := s.read()
+				if err != nil {
+					log.Errorf("unable to reload products file %q: %v", s.Path, err)
+					continue
+				}
+				select {
+				case out <- res:
+				case <-ctx.Done():
+					return
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("products file watch error: %v", err)
+			}
+		}
+	}()
+	return out, nil
+}
+
+// ProductsStreamClient is the subset of a generated gRPC client that
+// GRPCStreamSource needs. Defined here instead of depending directly on
+// generated code so callers can supply their own stub in tests.
+type ProductsStreamClient interface {
+	StreamProducts(ctx context.Context) (ProductsStream, error)
+}
+
+// ProductsStream receives one APIResponse per product update.
+type ProductsStream interface {
+	Recv() (*APIResponse, error)
+}
+
+// GRPCStreamSource subscribes to a server-streaming RPC that pushes product
+// updates as they happen, eliminating polling latency for fast rollouts.
+type GRPCStreamSource struct {
+	Client ProductsStreamClient
+}
+
+// Fetch is unsupported: GRPCStreamSource is push-based, so it only
+// implements Watch.
+func (s *GRPCStreamSource) Fetch(ctx context.Context) (APIResponse, error) {
+	return APIResponse{}, ErrFetchUnsupported
+}
+
+// Watch subscribes to the stream and forwards every update received.
+func (s *GRPCStreamSource) Watch(ctx context.Context) (<-chan APIResponse, error) {
+	stream, err := s.Client.StreamProducts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan APIResponse)
+	go func() {
+		defer close(out)
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("products stream ended: %v", err)
+				}
+				return
+			}
+			select {
+			case out <- *res:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
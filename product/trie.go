@@ -0,0 +1,192 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package product
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/apigee/apigee-remote-service-golib/log"
+)
+
+// pathEntry is a (target API, product name) pair attached to the node of a
+// pathIndex where its resource pattern terminates.
+type pathEntry struct {
+	api     string
+	product string
+}
+
+// patternChild is a non-literal path segment (one containing "*"), matched
+// with a compiled regex rather than an exact map lookup.
+type patternChild struct {
+	source string
+	regex  *regexp.Regexp
+	node   *trieNode
+}
+
+// trieNode is one path segment's worth of the index.
+type trieNode struct {
+	literals map[string]*trieNode
+	patterns []*patternChild
+	// entries whose resource pattern ends exactly at this depth.
+	entries []pathEntry
+	// entries whose resource pattern ended in "**" at this depth; they match
+	// this node and every path below it.
+	globstar []pathEntry
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{literals: map[string]*trieNode{}}
+}
+
+// pathIndex is a radix tree over resource path segments built once per
+// ProductsMap refresh, replacing a linear scan of every product's
+// []*regexp.Regexp resourceRegexps. matchAll holds entries for products with
+// a bare "/" resource, which matches every path and so is not worth indexing.
+type pathIndex struct {
+	root     *trieNode
+	matchAll []pathEntry
+}
+
+// buildPathIndex indexes every (resource, target) combination of every
+// product in pm so that Resolve can walk it segment-by-segment instead of
+// evaluating every product's resource regexps in turn.
+func buildPathIndex(pm ProductsMap) *pathIndex {
+	idx := &pathIndex{root: newTrieNode()}
+	for _, apiProduct := range pm {
+		for _, resource := range apiProduct.Resources {
+			for _, target := range apiProduct.Targets {
+				entry := pathEntry{api: target, product: apiProduct.Name}
+				if err := idx.insert(resource, entry); err != nil {
+					log.Errorf("unable to index resource %q for product %q, it will not match any path: %v",
+						resource, apiProduct.Name, err)
+				}
+			}
+		}
+	}
+	return idx
+}
+
+// insert adds entry at the node reached by resource's segments, preserving
+// makeResourceRegex's semantics: a bare "/" matches everything, "*" matches
+// within a single segment (possibly partially), and a "**" suffix matches
+// the remainder of the path. It returns an error, and does not index
+// resource at all, for the same malformed "**" specs makeResourceRegex
+// rejects, and for a "**" glued directly to a literal segment (e.g.
+// "/a/b**"): that compiles to a regex that can match partway through "b"
+// (e.g. "/a/bXYZ"), which isn't expressible as a segment-bounded lookup.
+// Leaving it unindexed is a safe, fail-closed gap - the resource is simply
+// unreachable via the index - rather than risk an over- or under-match.
+func (idx *pathIndex) insert(resource string, entry pathEntry) error {
+	if resource == "/" {
+		idx.matchAll = append(idx.matchAll, entry)
+		return nil
+	}
+
+	doubleStarIndex := strings.Index(resource, "**")
+	if doubleStarIndex >= 0 && doubleStarIndex != len(resource)-2 {
+		return fmt.Errorf("bad resource specification: %q", resource)
+	}
+	doubleStar := doubleStarIndex >= 0
+
+	base := resource
+	if doubleStar {
+		base = resource[:len(resource)-2]
+		if !strings.HasSuffix(base, "/") {
+			return fmt.Errorf("resource %q uses ** glued to a literal segment", resource)
+		}
+		base = strings.TrimSuffix(base, "/")
+	}
+
+	segments := splitPath(base)
+	node := idx.root
+	for _, seg := range segments {
+		node = node.child(seg)
+	}
+	if doubleStar {
+		node.globstar = append(node.globstar, entry)
+	} else {
+		node.entries = append(node.entries, entry)
+	}
+	return nil
+}
+
+// child returns (creating if needed) the child node for path segment seg.
+func (n *trieNode) child(seg string) *trieNode {
+	if !strings.Contains(seg, "*") {
+		child, ok := n.literals[seg]
+		if !ok {
+			child = newTrieNode()
+			n.literals[seg] = child
+		}
+		return child
+	}
+
+	for _, pc := range n.patterns {
+		if pc.source == seg {
+			return pc.node
+		}
+	}
+	pattern := "^" + strings.Replace(seg, "*", "[^/]*", -1) + "$"
+	pc := &patternChild{source: seg, regex: regexp.MustCompile(pattern), node: newTrieNode()}
+	n.patterns = append(n.patterns, pc)
+	return pc.node
+}
+
+// match returns every entry whose resource pattern matches requestPath.
+func (idx *pathIndex) match(requestPath string) []pathEntry {
+	result := append([]pathEntry{}, idx.matchAll...)
+	idx.root.walk(splitPath(requestPath), 0, &result)
+	return result
+}
+
+func (n *trieNode) walk(segments []string, i int, result *[]pathEntry) {
+	// A "**" suffix compiles to e.g. "^/a/.*$", which requires a literal
+	// trailing "/" after "a" - it does not match the bare path "/a". Only
+	// credit globstar entries when there's at least one more segment below
+	// this node; an exact-depth match falls through to n.entries instead.
+	if i < len(segments) {
+		*result = append(*result, n.globstar...)
+	}
+	if i == len(segments) {
+		*result = append(*result, n.entries...)
+		return
+	}
+	seg := segments[i]
+	if child, ok := n.literals[seg]; ok {
+		child.walk(segments, i+1, result)
+	}
+	for _, pc := range n.patterns {
+		if pc.regex.MatchString(seg) {
+			pc.node.walk(segments, i+1, result)
+		}
+	}
+}
+
+// splitPath splits a request or resource path into segments on "/", only
+// dropping the single leading empty segment the mandatory leading "/"
+// produces. Unlike a naive "drop every empty segment" split, this keeps a
+// trailing "/" (or a doubled "//" in the middle of a path) as a distinct
+// empty segment, matching the anchored regex makeResourceRegex builds:
+// "/a/*" matches request path "/a/" but not "/a/b/", which a split that
+// discarded all empty segments couldn't tell apart.
+func splitPath(p string) []string {
+	parts := strings.Split(p, "/")
+	if len(parts) > 0 && parts[0] == "" {
+		parts = parts[1:]
+	}
+	return parts
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package product
+
+import "testing"
+
+func TestPathIndexDoubleStarRequiresTrailingSegment(t *testing.T) {
+	idx := &pathIndex{root: newTrieNode()}
+	entry := pathEntry{api: "api1", product: "p1"}
+	if err := idx.insert("/a/**", entry); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	tests := []struct {
+		path  string
+		found bool
+	}{
+		{"/a", false}, // no trailing "/" - makeResourceRegex("/a/**") would not match this
+		{"/a/b", true},
+		{"/a/b/c", true},
+	}
+
+	for _, tt := range tests {
+		matched := false
+		for _, e := range idx.match(tt.path) {
+			if e == entry {
+				matched = true
+			}
+		}
+		if matched != tt.found {
+			t.Errorf("match(%q) = %v, want %v", tt.path, matched, tt.found)
+		}
+	}
+}
+
+func TestPathIndexLiteralAndWildcardSegments(t *testing.T) {
+	idx := &pathIndex{root: newTrieNode()}
+	literal := pathEntry{api: "api1", product: "literal"}
+	wildcard := pathEntry{api: "api1", product: "wildcard"}
+	partial := pathEntry{api: "api1", product: "partial"}
+
+	for _, ins := range []struct {
+		resource string
+		entry    pathEntry
+	}{
+		{"/foo/bar", literal},
+		{"/foo/*", wildcard},
+		{"/foo/ba*z", partial},
+	} {
+		if err := idx.insert(ins.resource, ins.entry); err != nil {
+			t.Fatalf("insert(%q): %v", ins.resource, err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		want []pathEntry
+	}{
+		{"/foo/bar", []pathEntry{literal, wildcard}},
+		{"/foo/baz", []pathEntry{wildcard, partial}},
+		{"/foo/other", []pathEntry{wildcard}},
+		{"/foo/bar/baz", nil},
+	}
+
+	for _, tt := range tests {
+		got := idx.match(tt.path)
+		if len(got) != len(tt.want) {
+			t.Errorf("match(%q) = %v, want %v", tt.path, got, tt.want)
+			continue
+		}
+		for _, w := range tt.want {
+			found := false
+			for _, g := range got {
+				if g == w {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("match(%q) = %v, missing %v", tt.path, got, w)
+			}
+		}
+	}
+}
+
+func TestPathIndexMatchAllResource(t *testing.T) {
+	idx := &pathIndex{root: newTrieNode()}
+	entry := pathEntry{api: "api1", product: "catchall"}
+	if err := idx.insert("/", entry); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	for _, path := range []string{"/", "/a", "/a/b/c", ""} {
+		found := false
+		for _, e := range idx.match(path) {
+			if e == entry {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("match(%q) did not include catch-all entry", path)
+		}
+	}
+}
+
+// TestPathIndexMatchesRegexSemantics compares the trie against
+// makeResourceRegex directly, resource by resource and path by path. This
+// exists because insert's fixed set of hand-picked cases above missed real
+// divergences - a trailing "/" on the request path, and a double slash in
+// the middle of one - that only showed up once the two matchers were run
+// side by side over a broader set of inputs.
+func TestPathIndexMatchesRegexSemantics(t *testing.T) {
+	resources := []string{
+		"/",
+		"/a",
+		"/a/*",
+		"/a/**",
+		"/a/b",
+		"/a/b/*",
+		"/a/b/**",
+		"/*/b",
+		"/a/*/c",
+	}
+	paths := []string{
+		"/",
+		"/a",
+		"/a/",
+		"/a/b",
+		"/a/b/",
+		"/a/b/c",
+		"/a/b/c/",
+		"/x",
+		"/a/x",
+		"/a/x/c",
+		"/a//c",
+	}
+
+	for _, resource := range resources {
+		reg, err := makeResourceRegex(resource)
+		if err != nil {
+			t.Fatalf("makeResourceRegex(%q): %v", resource, err)
+		}
+
+		idx := &pathIndex{root: newTrieNode()}
+		entry := pathEntry{api: "api1", product: resource}
+		if err := idx.insert(resource, entry); err != nil {
+			t.Fatalf("insert(%q): %v", resource, err)
+		}
+
+		for _, path := range paths {
+			want := reg.MatchString(path)
+
+			got := false
+			for _, e := range idx.match(path) {
+				if e == entry {
+					got = true
+				}
+			}
+
+			if got != want {
+				t.Errorf("resource %q, path %q: trie match = %v, regex match = %v", resource, path, got, want)
+			}
+		}
+	}
+}
+
+// TestPathIndexRejectsPatternsItCannotIndexSafely documents the two resource
+// shapes insert deliberately refuses to index rather than risk diverging
+// from makeResourceRegex: ** anywhere but the true suffix (which
+// makeResourceRegex itself rejects), and ** glued directly onto a literal
+// segment with no preceding "/" (which compiles to a mid-segment prefix
+// match a segment-bounded trie can't represent).
+func TestPathIndexRejectsPatternsItCannotIndexSafely(t *testing.T) {
+	for _, resource := range []string{"/a**/b", "/a/b**"} {
+		idx := &pathIndex{root: newTrieNode()}
+		if err := idx.insert(resource, pathEntry{api: "api1", product: "p1"}); err == nil {
+			t.Errorf("insert(%q) = nil error, want an error", resource)
+		}
+	}
+}